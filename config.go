@@ -0,0 +1,394 @@
+// Hot-reloadable service/config file: watches --config with fsnotify (and
+// SIGHUP), rebuilding the handler pipeline and swapping it in atomically so
+// in-flight requests and websocket connections drain instead of being
+// dropped.
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gorilla/handlers"
+	"github.com/jackspirou/syscerts"
+	"golang.org/x/net/http2"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// handlerSwapper is a http.Handler whose underlying handler can be swapped
+// out atomically, so a config reload never serves a half-built mux.
+type handlerSwapper struct {
+	current atomic.Value
+}
+
+func newHandlerSwapper(initial http.Handler) *handlerSwapper {
+	s := &handlerSwapper{}
+	s.current.Store(initial)
+	return s
+}
+
+func (s *handlerSwapper) Swap(h http.Handler) {
+	s.current.Store(h)
+}
+
+func (s *handlerSwapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.current.Load().(http.Handler).ServeHTTP(w, r)
+}
+
+// buildHandlers builds the network and unix-socket handler pipelines from
+// options: one ServeMux per service plus the static content handler, with
+// CORS, auth, the proxy round pipeline, and access-logging/metrics
+// instrumentation all wired in. unixHandler skips the auth middleware, since
+// filesystem permissions on the socket stand in for it. The returned
+// authenticator's refresh loop keeps running until the caller calls Stop on
+// it - on reload, the old one must be stopped once the new handlers are
+// swapped in.
+func buildHandlers(options *Options) (netHandler, unixHandler http.Handler, authenticator *oidcAuthenticator, err error) {
+	corsOpts := newCORSOptions(options)
+
+	authOpts := &AuthOptions{
+		Issuer:           options.OIDCIssuer,
+		ClientID:         options.OIDCClientID,
+		Audience:         options.OIDCAudience,
+		JWTSigningKey:    options.JWTSigningKey,
+		RequiredPrefixes: options.AuthRequiredPrefixes,
+	}
+	if len(authOpts.Audience) == 0 {
+		authOpts.Audience = authOpts.ClientID
+	}
+	authenticator, err = newOIDCAuthenticator(authOpts)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	mux := http.NewServeMux()
+	unixMux := http.NewServeMux()
+
+	instrument := func(servicePrefix, upstreamHost string, h http.Handler) http.Handler {
+		if len(options.MetricsAddr) > 0 {
+			h = metricsMiddleware(servicePrefix, h)
+		}
+		if options.AccessLogging {
+			h = accessLogMiddleware(options.LogFormat, servicePrefix, upstreamHost, h)
+		}
+		return h
+	}
+
+	if len(options.Services) > 0 {
+		tlsConfig := &tls.Config{
+			RootCAs:            syscerts.SystemRootsPool(),
+			InsecureSkipVerify: options.SkipCertValidation,
+		}
+		transport := &http.Transport{TLSClientConfig: tlsConfig}
+		// Setting TLSClientConfig above opts this Transport out of net/http's
+		// own automatic HTTP/2 enabling, so configure it explicitly - this
+		// must happen before instrumentTLSHandshakes installs a custom
+		// DialTLSContext, since ConfigureTransport is what arranges for the
+		// dialed *tls.Conn's negotiated protocol to be recognised afterwards.
+		if err := http2.ConfigureTransport(transport); err != nil {
+			return nil, nil, nil, fmt.Errorf("could not configure HTTP/2 for the backend transport: %v", err)
+		}
+		if len(options.MetricsAddr) > 0 {
+			instrumentTLSHandshakes(transport)
+		}
+		for _, caFile := range options.CACerts {
+			pemData, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if ok := tlsConfig.RootCAs.AppendCertsFromPEM(pemData); !ok {
+				return nil, nil, nil, fmt.Errorf("couldn't load PEM data from CA file %s", caFile)
+			}
+		}
+		for _, serviceDef := range options.Services {
+			serviceDef := serviceDef
+			actualHost, port, hostErr := validateServiceHost(serviceDef.url.Host)
+			if hostErr != nil {
+				if options.FailOnUnknownServices {
+					return nil, nil, nil, hostErr
+				}
+				log.Printf("Unknown service host: %s", serviceDef.url.Host)
+			} else {
+				if len(port) > 0 {
+					actualHost += ":" + port
+				}
+				serviceDef.url.Host = actualHost
+			}
+			log.Printf("Creating service proxy: %v => %v\n", serviceDef.prefix, serviceDef.url.String())
+			rp := httputil.NewSingleHostReverseProxy(serviceDef.url)
+			rp.Transport = transport
+			handler := http.StripPrefix(serviceDef.prefix, rp)
+			handler = applyRounds(buildProxyRounds(options, serviceDef.url, serviceDef.prefix), handler)
+
+			authHeader := ""
+			token := ""
+			if len(options.BearerTokenFile) > 0 {
+				data, tokenErr := ioutil.ReadFile(options.BearerTokenFile)
+				if tokenErr != nil {
+					return nil, nil, nil, tokenErr
+				}
+				token = string(data)
+				authHeader = "Bearer " + token
+			}
+			if len(authHeader) > 0 {
+				oldHandler := handler
+				handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					r.Header.Set("Authorization", authHeader)
+					oldHandler.ServeHTTP(w, r)
+				})
+			}
+			nextHandler := handler
+			handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if isWebsocket(r) {
+					websocketProxyHandler(serviceDef.prefix, serviceDef.url, tlsConfig, token, authHeader).ServeHTTP(w, r)
+					return
+				}
+				nextHandler.ServeHTTP(w, r)
+			})
+
+			unixMux.Handle(serviceDef.prefix, instrument(serviceDef.prefix, serviceDef.url.Host, corsMiddleware(corsOpts, handler)))
+			mux.Handle(serviceDef.prefix, instrument(serviceDef.prefix, serviceDef.url.Host, corsMiddleware(corsOpts, authMiddleware(authenticator, serviceDef.prefix, handler))))
+		}
+	}
+
+	if options.ServeWww {
+		httpDir := http.Dir(options.StaticDir)
+		staticHandler := http.FileServer(httpDir)
+		if options.StaticCacheMaxAge > 0 {
+			staticHandler = maxAgeHandler(options.StaticCacheMaxAge.Seconds(), staticHandler)
+		}
+		if len(options.DefaultPage) > 0 {
+			staticHandler = defaultPageHandler(options.DefaultPage, httpDir, staticHandler)
+		}
+		if options.CompressHandler {
+			staticHandler = handlers.CompressHandler(staticHandler)
+		}
+		staticHandler = instrument("static", "", corsMiddleware(corsOpts, staticHandler))
+		mux.Handle(options.StaticPrefix, staticHandler)
+		unixMux.Handle(options.StaticPrefix, staticHandler)
+	}
+
+	return mux, unixMux, authenticator, nil
+}
+
+// fileConfig is the YAML shape of --config, describing everything that can
+// be hot-reloaded: service mappings, CA certs, TLS certs, bearer token and
+// CORS/auth settings.
+type fileConfig struct {
+	Services        map[string]string `yaml:"services"`
+	CACerts         []string          `yaml:"caCerts"`
+	TLSCertFile     string            `yaml:"tlsCertFile"`
+	TLSKeyFile      string            `yaml:"tlsKeyFile"`
+	BearerTokenFile string            `yaml:"bearerTokenFile"`
+	CORS            struct {
+		AllowOrigins []string `yaml:"allowOrigins"`
+	} `yaml:"cors"`
+	Auth struct {
+		OIDCIssuer string `yaml:"oidcIssuer"`
+	} `yaml:"auth"`
+}
+
+func loadFileConfig(path string) (*fileConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fc := &fileConfig{}
+	if err := yaml.Unmarshal(data, fc); err != nil {
+		return nil, err
+	}
+	return fc, nil
+}
+
+// applyFileConfig merges the reloadable fields of a fileConfig into options,
+// leaving anything the file doesn't mention untouched.
+func applyFileConfig(options *Options, fc *fileConfig) {
+	if len(fc.Services) > 0 {
+		var svcs services
+		for prefix, rawURL := range fc.Services {
+			if err := svcs.Set(prefix + "=" + rawURL); err != nil {
+				log.Printf("Ignoring invalid service %q in config file: %v", prefix, err)
+			}
+		}
+		options.Services = svcs
+	}
+	if len(fc.CACerts) > 0 {
+		options.CACerts = fc.CACerts
+	}
+	if len(fc.TLSCertFile) > 0 && len(fc.TLSKeyFile) > 0 {
+		options.TlsCertFiles = tlsFiles{fc.TLSCertFile}
+		options.TlsKeyFiles = tlsFiles{fc.TLSKeyFile}
+	}
+	if len(fc.BearerTokenFile) > 0 {
+		options.BearerTokenFile = fc.BearerTokenFile
+	}
+	if len(fc.CORS.AllowOrigins) > 0 {
+		options.CORSAllowOrigins = fc.CORS.AllowOrigins
+	}
+	if len(fc.Auth.OIDCIssuer) > 0 {
+		options.OIDCIssuer = fc.Auth.OIDCIssuer
+	}
+}
+
+// referencedFiles returns every file path fc references - CA certs, the TLS
+// cert/key and the bearer token file - so watchConfig can fsnotify them too:
+// rotating one of these without touching the top-level config file itself
+// should still trigger a reload.
+func referencedFiles(fc *fileConfig) []string {
+	var files []string
+	files = append(files, fc.CACerts...)
+	if len(fc.TLSCertFile) > 0 {
+		files = append(files, fc.TLSCertFile)
+	}
+	if len(fc.TLSKeyFile) > 0 {
+		files = append(files, fc.TLSKeyFile)
+	}
+	if len(fc.BearerTokenFile) > 0 {
+		files = append(files, fc.BearerTokenFile)
+	}
+	return files
+}
+
+// watchConfig watches path (plus SIGHUP) and, on every change, reloads the
+// config file, merges it into options and rebuilds and atomically swaps the
+// handler pipeline behind netSwap/unixSwap. In-flight requests keep being
+// served by the old handler until they finish; only new requests see the
+// rebuilt one. It also watches the files fc references (CA/TLS certs,
+// bearer token) and, for specs with a TLS listener, reloads its certStore in
+// place so rotating a cert never requires a restart. initialAuth is the
+// authenticator buildHandlers produced for the handlers currently live; it's
+// stopped once a reload replaces it.
+//
+// Watches are placed on each file's parent directory rather than the file
+// itself: cert-manager renewals rotate a file by writing the new contents
+// under a temp name and renaming it into place, which replaces the inode
+// fsnotify is watching - a watch on the file only ever fires once. k8s
+// ConfigMap/Secret (projected) volumes go further and rotate by
+// atomically repointing a `..data` symlink at a new timestamped directory,
+// so the referenced filename's own directory entry never changes at all -
+// only `..data` and the timestamped directories do. Matching events by
+// filename would miss that entirely, so any event in a watched directory
+// triggers a reload, whichever name it's for.
+func watchConfig(path string, netSwap, unixSwap *handlerSwapper, specs []*listenerSpec, certStores []*certStore, initialAuth *oidcAuthenticator) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Could not watch config file %s: %v", path, err)
+		return
+	}
+
+	watchedDirs := map[string]bool{}
+
+	watchFile := func(f string) {
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			log.Printf("Could not resolve %s: %v", f, err)
+			return
+		}
+		dir := filepath.Dir(abs)
+		if watchedDirs[dir] {
+			return
+		}
+		if err := watcher.Add(dir); err != nil {
+			log.Printf("Could not watch directory %s for %s: %v", dir, f, err)
+			return
+		}
+		watchedDirs[dir] = true
+	}
+
+	watchReferencedFiles := func(fc *fileConfig) {
+		for _, f := range referencedFiles(fc) {
+			watchFile(f)
+		}
+	}
+
+	watchFile(path)
+	if fc, err := loadFileConfig(path); err == nil {
+		watchReferencedFiles(fc)
+	}
+
+	currentAuth := initialAuth
+
+	reload := func() {
+		fc, err := loadFileConfig(path)
+		if err != nil {
+			log.Printf("Could not reload config file %s: %v", path, err)
+			return
+		}
+		watchReferencedFiles(fc)
+		applyFileConfig(options, fc)
+
+		httpsIndex := 0
+		for i, store := range certStores {
+			if store == nil {
+				continue
+			}
+			certFile, keyFile := specs[i].certFile, specs[i].keyFile
+			if httpsIndex < len(options.TlsCertFiles) && httpsIndex < len(options.TlsKeyFiles) {
+				certFile, keyFile = options.TlsCertFiles[httpsIndex], options.TlsKeyFiles[httpsIndex]
+			}
+			if err := store.Reload(certFile, keyFile); err != nil {
+				log.Printf("Could not reload TLS cert for %s: %v", specs[i].raw, err)
+			}
+			httpsIndex++
+		}
+
+		netHandler, unixHandler, newAuth, err := buildHandlers(options)
+		if err != nil {
+			log.Printf("Could not rebuild handlers from %s: %v", path, err)
+			return
+		}
+		netSwap.Swap(netHandler)
+		unixSwap.Swap(unixHandler)
+		currentAuth.Stop()
+		currentAuth = newAuth
+		log.Printf("Reloaded config from %s\n", path)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) != 0 {
+					reload()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Config watcher error: %v", err)
+			case <-sigCh:
+				reload()
+			}
+		}
+	}()
+}
@@ -0,0 +1,133 @@
+// Support for CORS (Cross-Origin Resource Sharing) handling.
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CORSOptions configures the CORS middleware.
+type CORSOptions struct {
+	Enabled          bool
+	AllowOrigins     []string
+	AllowMethods     string
+	AllowHeaders     string
+	ExposeHeaders    string
+	AllowCredentials bool
+	MaxAge           int
+}
+
+func (o *CORSOptions) allowOrigin(origin string) string {
+	if len(origin) == 0 {
+		return ""
+	}
+	for _, allowed := range o.AllowOrigins {
+		if allowed == "*" {
+			if o.AllowCredentials {
+				// can't use a wildcard origin when credentials are allowed
+				return origin
+			}
+			return "*"
+		}
+		if allowed == origin {
+			return origin
+		}
+	}
+	return ""
+}
+
+// newCORSOptions builds the CORSOptions to use for the middleware from the
+// command line Options, applying the --cors shorthand if no explicit
+// --cors-allow-origin values were given.
+func newCORSOptions(options *Options) *CORSOptions {
+	origins := []string(options.CORSAllowOrigins)
+	enabled := options.EnableCORS || len(origins) > 0
+	if options.EnableCORS && len(origins) == 0 {
+		origins = []string{"*"}
+	}
+	return &CORSOptions{
+		Enabled:          enabled,
+		AllowOrigins:     origins,
+		AllowMethods:     options.CORSAllowMethods,
+		AllowHeaders:     options.CORSAllowHeaders,
+		ExposeHeaders:    options.CORSExposeHeaders,
+		AllowCredentials: options.CORSAllowCredentials,
+		MaxAge:           int(options.CORSMaxAge.Seconds()),
+	}
+}
+
+// corsMiddleware wraps a handler adding CORS response headers and answering
+// OPTIONS preflight requests, based on the given CORSOptions.
+func corsMiddleware(opts *CORSOptions, next http.Handler) http.Handler {
+	if opts == nil || !opts.Enabled {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowOrigin := opts.allowOrigin(origin)
+		if len(allowOrigin) > 0 {
+			w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+			if allowOrigin != "*" {
+				w.Header().Add("Vary", "Origin")
+			}
+			if opts.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			if len(opts.ExposeHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", opts.ExposeHeaders)
+			}
+		}
+
+		if r.Method == http.MethodOptions && len(r.Header.Get("Access-Control-Request-Method")) > 0 {
+			if len(allowOrigin) > 0 {
+				if len(opts.AllowMethods) > 0 {
+					w.Header().Set("Access-Control-Allow-Methods", opts.AllowMethods)
+				}
+				if len(opts.AllowHeaders) > 0 {
+					w.Header().Set("Access-Control-Allow-Headers", opts.AllowHeaders)
+				} else if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); len(reqHeaders) > 0 {
+					w.Header().Set("Access-Control-Allow-Headers", reqHeaders)
+				}
+				if opts.MaxAge > 0 {
+					w.Header().Set("Access-Control-Max-Age", strconv.Itoa(opts.MaxAge))
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// corsOrigins is a repeatable pflag.Value collecting --cors-allow-origin values.
+type corsOrigins []string
+
+func (o *corsOrigins) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *corsOrigins) Set(value string) error {
+	*o = append(*o, value)
+	return nil
+}
+
+func (o *corsOrigins) Type() string {
+	return "stringArray"
+}
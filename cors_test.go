@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSOptionsAllowOrigin(t *testing.T) {
+	tests := []struct {
+		name             string
+		allowOrigins     []string
+		allowCredentials bool
+		origin           string
+		want             string
+	}{
+		{"no origin header", []string{"*"}, false, "", ""},
+		{"wildcard without credentials", []string{"*"}, false, "https://example.com", "*"},
+		{"wildcard with credentials reflects origin", []string{"*"}, true, "https://example.com", "https://example.com"},
+		{"exact match", []string{"https://a.example.com", "https://b.example.com"}, false, "https://b.example.com", "https://b.example.com"},
+		{"no match", []string{"https://a.example.com"}, false, "https://evil.example.com", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := &CORSOptions{AllowOrigins: tt.allowOrigins, AllowCredentials: tt.allowCredentials}
+			if got := opts.allowOrigin(tt.origin); got != tt.want {
+				t.Errorf("allowOrigin(%q) = %q, want %q", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCORSMiddlewareDisabled(t *testing.T) {
+	called := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	h := corsMiddleware(&CORSOptions{Enabled: false}, next)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Origin", "https://example.com")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if !called {
+		t.Error("disabled CORS middleware did not call through to next")
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("disabled CORS middleware set Access-Control-Allow-Origin: %q", got)
+	}
+}
+
+func TestCORSMiddlewarePreflight(t *testing.T) {
+	opts := &CORSOptions{
+		Enabled:          true,
+		AllowOrigins:     []string{"https://example.com"},
+		AllowMethods:     "GET, POST",
+		AllowCredentials: true,
+		MaxAge:           600,
+	}
+	called := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true })
+	h := corsMiddleware(opts, next)
+
+	req := httptest.NewRequest(http.MethodOptions, "/", nil)
+	req.Header.Set("Origin", "https://example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "X-Custom")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if called {
+		t.Error("preflight request should short-circuit, not reach next")
+	}
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("preflight status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://example.com" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, "https://example.com")
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Methods"); got != "GET, POST" {
+		t.Errorf("Access-Control-Allow-Methods = %q, want %q", got, "GET, POST")
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Headers"); got != "X-Custom" {
+		t.Errorf("Access-Control-Allow-Headers = %q, want %q (echoed request headers)", got, "X-Custom")
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("Access-Control-Allow-Credentials = %q, want %q", got, "true")
+	}
+	if got := rec.Header().Get("Access-Control-Max-Age"); got != "600" {
+		t.Errorf("Access-Control-Max-Age = %q, want %q", got, "600")
+	}
+}
+
+func TestCORSMiddlewarePreflightDisallowedOrigin(t *testing.T) {
+	opts := &CORSOptions{Enabled: true, AllowOrigins: []string{"https://example.com"}}
+	h := corsMiddleware(opts, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodOptions, "/", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("preflight status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want empty for a disallowed origin", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Methods"); got != "" {
+		t.Errorf("Access-Control-Allow-Methods = %q, want empty for a disallowed origin", got)
+	}
+}
+
+func TestCORSMiddlewareSimpleRequest(t *testing.T) {
+	opts := &CORSOptions{Enabled: true, AllowOrigins: []string{"*"}}
+	called := false
+	h := corsMiddleware(opts, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Origin", "https://example.com")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if !called {
+		t.Error("non-preflight request did not reach next")
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, "*")
+	}
+	if got := rec.Header().Get("Vary"); got != "" {
+		t.Errorf("Vary = %q, want empty for a wildcard origin", got)
+	}
+}
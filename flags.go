@@ -0,0 +1,126 @@
+// Repeatable --service/--config-file/--ca-cert flag types, and the template
+// substitution behind --config-file.
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// serviceDef is a single --service entry: a URL path prefix and the backend
+// it's reverse-proxied to.
+type serviceDef struct {
+	prefix string
+	url    *url.URL
+}
+
+// services is a repeatable pflag.Value collecting --service values of the
+// form "<prefix>=<serviceUrl>".
+type services []serviceDef
+
+func (s *services) String() string {
+	parts := make([]string, len(*s))
+	for i, svc := range *s {
+		parts[i] = svc.prefix + "=" + svc.url.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (s *services) Set(value string) error {
+	prefix, rawURL, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("invalid --service %q, expected \"<prefix>=<serviceUrl>\"", value)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid --service URL %q: %v", rawURL, err)
+	}
+	*s = append(*s, serviceDef{prefix: prefix, url: u})
+	return nil
+}
+
+func (s *services) Type() string {
+	return "stringArray"
+}
+
+// configDef is a single --config-file entry: a template file to render and
+// the path to write the result to.
+type configDef struct {
+	template string
+	output   string
+}
+
+// configs is a repeatable pflag.Value collecting --config-file values of the
+// form "<template>=<output>".
+type configs []configDef
+
+func (c *configs) String() string {
+	parts := make([]string, len(*c))
+	for i, cfg := range *c {
+		parts[i] = cfg.template + "=" + cfg.output
+	}
+	return strings.Join(parts, ",")
+}
+
+func (c *configs) Set(value string) error {
+	template, output, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("invalid --config-file %q, expected \"<template>=<output>\"", value)
+	}
+	*c = append(*c, configDef{template: template, output: output})
+	return nil
+}
+
+func (c *configs) Type() string {
+	return "stringArray"
+}
+
+// caCerts is a repeatable pflag.Value collecting --ca-cert values.
+type caCerts []string
+
+func (c *caCerts) String() string {
+	return strings.Join(*c, ",")
+}
+
+func (c *caCerts) Set(value string) error {
+	*c = append(*c, value)
+	return nil
+}
+
+func (c *caCerts) Type() string {
+	return "stringArray"
+}
+
+// createConfig renders template by expanding ${VAR}/$VAR references against
+// the process environment and writes the result to output, e.g. for
+// generating a service's config file from a template baked into its image
+// with environment-specific values substituted at container start.
+func createConfig(template, output string) error {
+	data, err := ioutil.ReadFile(template)
+	if err != nil {
+		return fmt.Errorf("could not read config template %s: %v", template, err)
+	}
+	expanded := os.Expand(string(data), os.Getenv)
+	if err := ioutil.WriteFile(output, []byte(expanded), 0644); err != nil {
+		return fmt.Errorf("could not write config file %s: %v", output, err)
+	}
+	return nil
+}
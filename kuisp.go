@@ -17,45 +17,58 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/handlers"
-	"github.com/jackspirou/syscerts"
-	"github.com/koding/websocketproxy"
-	"github.com/gorilla/websocket"
-
 	flag "github.com/spf13/pflag"
 )
 
 type Options struct {
-	Port                  int
-	StaticDir             string
-	StaticPrefix          string
-	DefaultPage           string
-	StaticCacheMaxAge     time.Duration
-	Services              services
-	FailOnUnknownServices bool
-	Configs               configs
-	CACerts               caCerts
-	SkipCertValidation    bool
-	TlsCertFile           string
-	TlsKeyFile            string
-	AccessLogging         bool
-	CompressHandler       bool
-	BearerTokenFile       string
-	ServeWww              bool
-	EnableCORS            bool
+	Port                      int
+	StaticDir                 string
+	StaticPrefix              string
+	DefaultPage               string
+	StaticCacheMaxAge         time.Duration
+	Services                  services
+	FailOnUnknownServices     bool
+	Configs                   configs
+	CACerts                   caCerts
+	SkipCertValidation        bool
+	Addrs                     addrs
+	TlsCertFiles              tlsFiles
+	TlsKeyFiles               tlsFiles
+	UnixSocketMode            string
+	AccessLogging             bool
+	CompressHandler           bool
+	BearerTokenFile           string
+	ServeWww                  bool
+	EnableCORS                bool
+	CORSAllowOrigins          corsOrigins
+	CORSAllowMethods          string
+	CORSAllowHeaders          string
+	CORSExposeHeaders         string
+	CORSAllowCredentials      bool
+	CORSMaxAge                time.Duration
+	OIDCIssuer                string
+	OIDCClientID              string
+	OIDCAudience              string
+	JWTSigningKey             string
+	AuthRequiredPrefixes      authPrefixes
+	ProxyRewriteLinks         bool
+	ProxyStripRequestHeaders  headerNames
+	ProxyInjectRequestHeaders headerMap
+	LogFormat                 string
+	MetricsAddr               string
+	ConfigFile                string
 }
 
 var options = &Options{}
@@ -69,15 +82,34 @@ func initFlags() {
 	flag.VarP(&options.Services, "service", "s", "The Kubernetes services to proxy to in the form \"<prefix>=<serviceUrl>\"")
 	flag.VarP(&options.Configs, "config-file", "c", "The configuration files to create in the form \"<template>=<output>\"")
 	flag.Var(&options.CACerts, "ca-cert", "CA certs used to verify proxied server certificates")
-	flag.StringVar(&options.TlsCertFile, "tls-cert", "", "Certificate file to use to serve using TLS")
-	flag.StringVar(&options.TlsKeyFile, "tls-key", "", "Certificate file to use to serve using TLS")
+	flag.VarP(&options.Addrs, "addr", "a", "Address to listen on, may be repeated, e.g. ':8080', '127.0.0.1:9000', 'unix:///run/kuisp.sock' or 'https://:8443'. Defaults to ':<port>' (or 'https://:<port>' if --tls-cert/--tls-key are set)")
+	flag.Var(&options.TlsCertFiles, "tls-cert", "Certificate file to use to serve using TLS, may be repeated; matched positionally to the https:// --addr of the same index")
+	flag.Var(&options.TlsKeyFiles, "tls-key", "Certificate key file to use to serve using TLS, may be repeated; matched positionally to the https:// --addr of the same index")
+	flag.StringVar(&options.UnixSocketMode, "unix-socket-mode", "0660", "File mode to chmod a unix:// --addr socket to once bound")
 	flag.BoolVar(&options.SkipCertValidation, "skip-cert-validation", false, "Skip remote certificate validation - dangerous!")
 	flag.BoolVarP(&options.AccessLogging, "access-logging", "l", false, "Enable access logging")
 	flag.BoolVar(&options.CompressHandler, "compress", false, "Enable gzip/deflate response compression")
 	flag.BoolVar(&options.FailOnUnknownServices, "fail-on-unknown-services", false, "Fail on unknown services in DNS")
 	flag.BoolVar(&options.ServeWww, "serve-www", true, "Whether to serve static content")
-	flag.BoolVar(&options.EnableCORS, "cors", false, "Whether to enable CORS")
+	flag.BoolVar(&options.EnableCORS, "cors", false, "Whether to enable CORS (shorthand for --cors-allow-origin='*')")
+	flag.VarP(&options.CORSAllowOrigins, "cors-allow-origin", "", "Origin(s) to allow via CORS, may be repeated. Use '*' to allow any origin")
+	flag.StringVar(&options.CORSAllowMethods, "cors-allow-methods", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS", "Value of the Access-Control-Allow-Methods header sent in response to preflight requests")
+	flag.StringVar(&options.CORSAllowHeaders, "cors-allow-headers", "", "Value of the Access-Control-Allow-Headers header sent in response to preflight requests. Defaults to echoing Access-Control-Request-Headers")
+	flag.StringVar(&options.CORSExposeHeaders, "cors-expose-headers", "", "Value of the Access-Control-Expose-Headers header")
+	flag.BoolVar(&options.CORSAllowCredentials, "cors-allow-credentials", false, "Whether to send Access-Control-Allow-Credentials: true")
+	flag.DurationVar(&options.CORSMaxAge, "cors-max-age", 0, "Value of the Access-Control-Max-Age header sent in response to preflight requests, e.g. 10m")
 	flag.StringVar(&options.BearerTokenFile, "bearer-token", "", "Specify the file to use as the Bearer token for Authorization header")
+	flag.StringVar(&options.OIDCIssuer, "oidc-issuer", "", "OIDC issuer URL used to discover the JWKS endpoint for validating inbound bearer JWTs, e.g. https://dex.example.com")
+	flag.StringVar(&options.OIDCClientID, "oidc-client-id", "", "OIDC client ID of this proxy. Only used to default --oidc-audience: kuisp mints its own downstream token from validated claims rather than exchanging one with the issuer, so there is no --oidc-client-secret and no client credential is ever sent to the issuer")
+	flag.StringVar(&options.OIDCAudience, "oidc-audience", "", "Expected audience of inbound bearer JWTs. Defaults to --oidc-client-id if unset")
+	flag.StringVar(&options.JWTSigningKey, "jwt-signing-key", "", "Signing key used to mint a downstream token (carrying the validated claims) to inject into the proxied request")
+	flag.VarP(&options.AuthRequiredPrefixes, "auth-required-prefix", "", "Service prefix(es) that require a valid bearer JWT, may be repeated. Defaults to all service prefixes when --oidc-issuer is set")
+	flag.BoolVar(&options.ProxyRewriteLinks, "proxy-rewrite-links", false, "Rewrite absolute URLs in the Location header and HTML href/src attributes that point at a proxied service's backend to its public prefix")
+	flag.Var(&options.ProxyStripRequestHeaders, "proxy-strip-request-header", "Request header(s) to strip before forwarding to a proxied service, may be repeated")
+	flag.Var(&options.ProxyInjectRequestHeaders, "proxy-inject-request-header", "Request header(s) of the form Name=value to inject before forwarding to a proxied service, may be repeated")
+	flag.StringVar(&options.LogFormat, "log-format", logFormatCombined, "Access log format to use when --access-logging is set: json, combined or common")
+	flag.StringVar(&options.MetricsAddr, "metrics-addr", "", "Address to serve a Prometheus /metrics endpoint on, e.g. ':9100'. Disabled if unset")
+	flag.StringVar(&options.ConfigFile, "config", "", "YAML file describing services, CA/TLS certs, bearer token and CORS/auth settings. Watched with fsnotify and reloaded on change or SIGHUP")
 	flag.Parse()
 }
 
@@ -85,161 +117,70 @@ func main() {
 	initFlags()
 
 	if len(options.Configs) > 0 {
-		for _, configDef := range options.Configs {
-			log.Printf("Creating config file:  %v => %v\n", configDef.template, configDef.output)
-			createConfig(configDef.template, configDef.output)
+		for _, cfg := range options.Configs {
+			log.Printf("Creating config file:  %v => %v\n", cfg.template, cfg.output)
+			if err := createConfig(cfg.template, cfg.output); err != nil {
+				log.Fatal(err)
+			}
 		}
 		log.Println()
 	}
 
-	if len(options.Services) > 0 {
-		tlsConfig := &tls.Config{
-			RootCAs:            syscerts.SystemRootsPool(),
-			InsecureSkipVerify: options.SkipCertValidation,
-		}
-		transport := &http.Transport{TLSClientConfig: tlsConfig}
-		if len(options.CACerts) > 0 {
-			for _, caFile := range options.CACerts {
-				// Load our trusted certificate path
-				pemData, err := ioutil.ReadFile(caFile)
-				if err != nil {
-					log.Fatal("Couldn't read CA file, ", caFile, ": ", err)
-				}
-				if ok := tlsConfig.RootCAs.AppendCertsFromPEM(pemData); !ok {
-					log.Fatal("Couldn't load PEM data from CA file, ", caFile)
-				}
-			}
-		}
-		for _, serviceDef := range options.Services {
-			actualHost, port, err := validateServiceHost(serviceDef.url.Host)
-			if err != nil {
-				if options.FailOnUnknownServices {
-					log.Fatalf("Unknown service host: %s", serviceDef.url.Host)
-				} else {
-					log.Printf("Unknown service host: %s", serviceDef.url.Host)
-				}
-			} else {
-				if len(port) > 0 {
-					actualHost += ":" + port
-				}
-				serviceDef.url.Host = actualHost
-			}
-			log.Printf("Creating service proxy: %v => %v\n", serviceDef.prefix, serviceDef.url.String())
-			rp := httputil.NewSingleHostReverseProxy(serviceDef.url)
-			rp.Transport = transport
-			handler := http.StripPrefix(serviceDef.prefix, rp)
-
-			authHeader := ""
-			token := ""
-			if len(options.BearerTokenFile) > 0 {
-				data, err := ioutil.ReadFile(options.BearerTokenFile)
-				if err != nil {
-					log.Fatalf("Could not load Bearer token file %s due to %v", options.BearerTokenFile, err)
-				}
-				token = string(data)
-				authHeader = "Bearer " + token
-			}
-			if len(authHeader) > 0 {
-				oldHandler := handler
-				handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-					r.Header.Set("Authorization", authHeader)
-					if options.EnableCORS {
-						w.Header().Set("Access-Control-Allow-Origin", "*")
-					}
-					oldHandler.ServeHTTP(w, r)
-				})
-			}
-			nextHandler := handler
-			handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				if isWebsocket(r) {
-					// shallow copy
-					u := *r.URL
-					u.Host = serviceDef.url.Host
-					u.Scheme = "wss"
-					u.Path = strings.TrimPrefix(u.Path, serviceDef.prefix)
-
-					// lets add the token if its missing
-					parameters := u.Query()
-					if len(token) > 0 {
-						tokenParam := parameters.Get("access_token")
-						if len(tokenParam) == 0 {
-							parameters.Set("access_token", token)
-							u.RawQuery = parameters.Encode()
-						}
-					}
-					log.Printf("Creating websocket proxy to %v\n", &u)
+	if len(options.MetricsAddr) > 0 {
+		serveMetrics(options.MetricsAddr)
+	}
 
-					// shallow copy
-					pr := *r
-					pr.URL = &u
+	netHandler, unixHandler, authenticator, err := buildHandlers(options)
+	if err != nil {
+		log.Fatal(err)
+	}
+	netSwap := newHandlerSwapper(netHandler)
+	unixSwap := newHandlerSwapper(unixHandler)
 
-					/*
-					if len(authHeader) > 0 {
-						r.Header.Set("Authorization", authHeader)
-					}
-					if options.EnableCORS {
-						w.Header().Set("Access-Control-Allow-Origin", "*")
-					}
-					*/
-					proxy := websocketproxy.NewProxy(&u)
-					proxy.Dialer = &websocket.Dialer{
-						Proxy: func(r *http.Request) (*url.URL, error) {
-							return &u, nil
-						},
-					}
+	registerMimeTypes()
 
-					// lets use the same TLS config?
-					//proxy.Dialer.TLSClientConfig = tlsConfig
-					proxy.ServeHTTP(w, &pr)
-					return
-				}
-				//log.Printf("Serving regular http traffic on %v\n", r.URL)
-				nextHandler.ServeHTTP(w, r)
-				return
-			})
+	var handler http.Handler = netSwap
+	var unixHTTPHandler http.Handler = unixSwap
 
-			http.Handle(serviceDef.prefix, handler)
-		}
-		log.Println()
+	socketMode, err := parseSocketMode(options.UnixSocketMode)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	if options.ServeWww {
-		httpDir := http.Dir(options.StaticDir)
-		staticHandler := http.FileServer(httpDir)
-		if options.StaticCacheMaxAge > 0 {
-			staticHandler = maxAgeHandler(options.StaticCacheMaxAge.Seconds(), staticHandler)
-		}
-
-		if len(options.DefaultPage) > 0 {
-			staticHandler = defaultPageHandler(options.DefaultPage, httpDir, staticHandler)
-		}
-		if options.CompressHandler {
-			staticHandler = handlers.CompressHandler(staticHandler)
+	specs, err := buildListenerSpecs(options.Addrs, options.TlsCertFiles, options.TlsKeyFiles)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(specs) == 0 {
+		defaultAddr := fmt.Sprintf(":%d", options.Port)
+		if len(options.TlsCertFiles) > 0 && len(options.TlsKeyFiles) > 0 {
+			specs = []*listenerSpec{{raw: "https://" + defaultAddr, scheme: "https", address: defaultAddr, certFile: options.TlsCertFiles[0], keyFile: options.TlsKeyFiles[0]}}
+		} else {
+			specs = []*listenerSpec{{raw: defaultAddr, scheme: "http", address: defaultAddr}}
 		}
-		http.Handle(options.StaticPrefix, staticHandler)
 	}
 
-	log.Printf("Listening on :%d\n", options.Port)
-	log.Println()
-
-	registerMimeTypes()
-
-	srv := &http.Server{
-		Addr: fmt.Sprintf(":%d", options.Port),
+	certStores, err := newCertStores(specs)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	var handler http.Handler = http.DefaultServeMux
-
-	if options.AccessLogging {
-		handler = handlers.CombinedLoggingHandler(os.Stdout, handler)
+	if len(options.ConfigFile) > 0 {
+		watchConfig(options.ConfigFile, netSwap, unixSwap, specs, certStores, authenticator)
 	}
 
-	srv.Handler = handler
+	log.Println()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		cancel()
+	}()
 
-	if len(options.TlsCertFile) > 0 && len(options.TlsKeyFile) > 0 {
-		log.Fatal(srv.ListenAndServeTLS(options.TlsCertFile, options.TlsKeyFile))
-	} else {
-		log.Fatal(srv.ListenAndServe())
+	if err := serveListeners(ctx, specs, certStores, handler, unixHTTPHandler, socketMode); err != nil {
+		log.Fatal(err)
 	}
 }
 
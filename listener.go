@@ -0,0 +1,256 @@
+// Multi-listener support: repeatable --addr flags with per-listener TLS,
+// HTTP/2 and Unix socket binding.
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/sync/errgroup"
+)
+
+// shutdownTimeout bounds how long in-flight requests are given to drain
+// on each listener before the process exits.
+const shutdownTimeout = 30 * time.Second
+
+// addrs is a repeatable pflag.Value collecting --addr values.
+type addrs []string
+
+func (a *addrs) String() string {
+	return strings.Join(*a, ",")
+}
+
+func (a *addrs) Set(value string) error {
+	*a = append(*a, value)
+	return nil
+}
+
+func (a *addrs) Type() string {
+	return "stringArray"
+}
+
+// tlsFiles is a repeatable pflag.Value collecting --tls-cert/--tls-key
+// values, positionally associated with the --addr of the same index.
+type tlsFiles []string
+
+func (f *tlsFiles) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *tlsFiles) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func (f *tlsFiles) Type() string {
+	return "stringArray"
+}
+
+// listenerSpec is a single --addr entry parsed into its scheme and address.
+type listenerSpec struct {
+	raw      string
+	scheme   string // "http", "https" or "unix"
+	address  string // host:port for http/https, socket path for unix
+	certFile string
+	keyFile  string
+}
+
+func (s *listenerSpec) tls() bool {
+	return s.scheme == "https"
+}
+
+func (s *listenerSpec) unix() bool {
+	return s.scheme == "unix"
+}
+
+// parseListenerSpec parses a single --addr value, e.g. ":8080",
+// "127.0.0.1:9000", "unix:///run/kuisp.sock" or "https://:8443".
+func parseListenerSpec(raw string) (*listenerSpec, error) {
+	switch {
+	case strings.HasPrefix(raw, "unix://"):
+		return &listenerSpec{raw: raw, scheme: "unix", address: strings.TrimPrefix(raw, "unix://")}, nil
+	case strings.HasPrefix(raw, "https://"):
+		return &listenerSpec{raw: raw, scheme: "https", address: strings.TrimPrefix(raw, "https://")}, nil
+	case strings.HasPrefix(raw, "http://"):
+		return &listenerSpec{raw: raw, scheme: "http", address: strings.TrimPrefix(raw, "http://")}, nil
+	default:
+		return &listenerSpec{raw: raw, scheme: "http", address: raw}, nil
+	}
+}
+
+// buildListenerSpecs parses --addr, pairing each https entry positionally
+// with the --tls-cert/--tls-key of the same index.
+func buildListenerSpecs(addrValues, certFiles, keyFiles []string) ([]*listenerSpec, error) {
+	if len(addrValues) == 0 {
+		return nil, nil
+	}
+	specs := make([]*listenerSpec, 0, len(addrValues))
+	tlsIndex := 0
+	for _, raw := range addrValues {
+		spec, err := parseListenerSpec(raw)
+		if err != nil {
+			return nil, err
+		}
+		if spec.tls() {
+			if tlsIndex >= len(certFiles) || tlsIndex >= len(keyFiles) {
+				return nil, fmt.Errorf("--addr %s requires a matching --tls-cert and --tls-key at position %d", raw, tlsIndex)
+			}
+			spec.certFile = certFiles[tlsIndex]
+			spec.keyFile = keyFiles[tlsIndex]
+			tlsIndex++
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// certStore holds a single TLS certificate that can be atomically swapped
+// out, wired into a listener's tls.Config via GetCertificate so rotating the
+// cert/key files on disk (e.g. cert-manager renewal) doesn't require
+// rebinding the listener or restarting the process.
+type certStore struct {
+	current atomic.Value // *tls.Certificate
+}
+
+// newCertStore loads the initial cert/key pair into a new certStore.
+func newCertStore(certFile, keyFile string) (*certStore, error) {
+	s := &certStore{}
+	if err := s.Reload(certFile, keyFile); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload loads certFile/keyFile and atomically swaps them in; in-flight and
+// future handshakes see the new cert without the listener being rebuilt.
+func (s *certStore) Reload(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	s.current.Store(&cert)
+	return nil
+}
+
+func (s *certStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.current.Load().(*tls.Certificate), nil
+}
+
+// newCertStores builds a certStore for every TLS listener spec, in the same
+// order as specs (nil for non-TLS specs).
+func newCertStores(specs []*listenerSpec) ([]*certStore, error) {
+	stores := make([]*certStore, len(specs))
+	for i, spec := range specs {
+		if !spec.tls() {
+			continue
+		}
+		store, err := newCertStore(spec.certFile, spec.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load TLS cert/key for %s: %v", spec.raw, err)
+		}
+		stores[i] = store
+	}
+	return stores, nil
+}
+
+// serveListeners binds every listener spec and serves the appropriate
+// handler on each, returning once the context is cancelled and every
+// listener has drained. Unix socket listeners serve unixHandler (bypassing
+// auth middleware, since filesystem permissions on the socket replace it);
+// every other listener serves netHandler. certStores must be the same
+// length as specs (see newCertStores) and live for the life of the process,
+// so watchConfig can rotate a TLS listener's cert in place.
+func serveListeners(ctx context.Context, specs []*listenerSpec, certStores []*certStore, netHandler, unixHandler http.Handler, socketMode os.FileMode) error {
+	g, ctx := errgroup.WithContext(ctx)
+	servers := make([]*http.Server, len(specs))
+
+	for i, spec := range specs {
+		i, spec := i, spec
+		ln, err := listen(ctx, spec, socketMode)
+		if err != nil {
+			return fmt.Errorf("could not listen on %s: %v", spec.raw, err)
+		}
+
+		handler := netHandler
+		if spec.unix() {
+			handler = unixHandler
+		}
+		srv := &http.Server{Handler: handler}
+		servers[i] = srv
+
+		if spec.tls() {
+			srv.TLSConfig = &tls.Config{GetCertificate: certStores[i].GetCertificate}
+			if err := http2.ConfigureServer(srv, &http2.Server{}); err != nil {
+				return fmt.Errorf("could not configure HTTP/2 for %s: %v", spec.raw, err)
+			}
+			ln = tls.NewListener(ln, srv.TLSConfig)
+		}
+
+		g.Go(func() error {
+			log.Printf("Listening on %s\n", spec.raw)
+			if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+				return err
+			}
+			return nil
+		})
+	}
+
+	<-ctx.Done()
+	for _, srv := range servers {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		_ = srv.Shutdown(shutdownCtx)
+		cancel()
+	}
+	return g.Wait()
+}
+
+func listen(ctx context.Context, spec *listenerSpec, socketMode os.FileMode) (net.Listener, error) {
+	if spec.unix() {
+		if err := os.Remove(spec.address); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		ln, err := net.Listen("unix", spec.address)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(spec.address, socketMode); err != nil {
+			return nil, err
+		}
+		return ln, nil
+	}
+	return reusePortListenConfig().Listen(ctx, "tcp", spec.address)
+}
+
+// parseSocketMode parses the --unix-socket-mode flag, e.g. "0660".
+func parseSocketMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid socket mode %q: %v", value, err)
+	}
+	return os.FileMode(mode), nil
+}
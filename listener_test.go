@@ -0,0 +1,73 @@
+package main
+
+import "testing"
+
+func TestParseListenerSpec(t *testing.T) {
+	tests := []struct {
+		raw        string
+		wantScheme string
+		wantAddr   string
+	}{
+		{":8080", "http", ":8080"},
+		{"127.0.0.1:9000", "http", "127.0.0.1:9000"},
+		{"http://:8080", "http", ":8080"},
+		{"https://:8443", "https", ":8443"},
+		{"unix:///run/kuisp.sock", "unix", "/run/kuisp.sock"},
+	}
+	for _, tt := range tests {
+		spec, err := parseListenerSpec(tt.raw)
+		if err != nil {
+			t.Fatalf("parseListenerSpec(%q): %v", tt.raw, err)
+		}
+		if spec.scheme != tt.wantScheme {
+			t.Errorf("parseListenerSpec(%q).scheme = %q, want %q", tt.raw, spec.scheme, tt.wantScheme)
+		}
+		if spec.address != tt.wantAddr {
+			t.Errorf("parseListenerSpec(%q).address = %q, want %q", tt.raw, spec.address, tt.wantAddr)
+		}
+	}
+}
+
+// TestBuildListenerSpecsTLSIndexing verifies --tls-cert/--tls-key are matched
+// positionally among the https:// --addr entries only, not against the
+// global --addr index - so a plain http --addr ahead of an https one doesn't
+// throw off the pairing.
+func TestBuildListenerSpecsTLSIndexing(t *testing.T) {
+	addrs := []string{":8080", "https://:8443", "https://:8444"}
+	certFiles := []string{"cert0.pem", "cert1.pem"}
+	keyFiles := []string{"key0.pem", "key1.pem"}
+
+	specs, err := buildListenerSpecs(addrs, certFiles, keyFiles)
+	if err != nil {
+		t.Fatalf("buildListenerSpecs: %v", err)
+	}
+	if len(specs) != 3 {
+		t.Fatalf("got %d specs, want 3", len(specs))
+	}
+	if specs[0].certFile != "" || specs[0].keyFile != "" {
+		t.Errorf("plain http spec got cert/key %q/%q, want empty", specs[0].certFile, specs[0].keyFile)
+	}
+	if specs[1].certFile != "cert0.pem" || specs[1].keyFile != "key0.pem" {
+		t.Errorf("first https spec got cert/key %q/%q, want cert0.pem/key0.pem", specs[1].certFile, specs[1].keyFile)
+	}
+	if specs[2].certFile != "cert1.pem" || specs[2].keyFile != "key1.pem" {
+		t.Errorf("second https spec got cert/key %q/%q, want cert1.pem/key1.pem", specs[2].certFile, specs[2].keyFile)
+	}
+}
+
+func TestBuildListenerSpecsMissingTLSFiles(t *testing.T) {
+	_, err := buildListenerSpecs([]string{"https://:8443"}, nil, nil)
+	if err == nil {
+		t.Fatal("expected an error for an https:// --addr with no --tls-cert/--tls-key")
+	}
+}
+
+func TestBuildListenerSpecsEmpty(t *testing.T) {
+	specs, err := buildListenerSpecs(nil, nil, nil)
+	if err != nil {
+		t.Fatalf("buildListenerSpecs(nil): %v", err)
+	}
+	if specs != nil {
+		t.Errorf("buildListenerSpecs(nil) = %v, want nil", specs)
+	}
+}
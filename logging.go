@@ -0,0 +1,123 @@
+// Structured JSON access logging, selectable alongside the existing Apache
+// combined/common log formats.
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/handlers"
+)
+
+const (
+	logFormatJSON     = "json"
+	logFormatCombined = "combined"
+	logFormatCommon   = "common"
+)
+
+// statusRecorder wraps a http.ResponseWriter, capturing the status code and
+// byte count written so access logging and metrics can report them. It
+// passes through Hijack so upgraded (websocket) connections still work, and
+// Flush so streamed/chunked proxied responses aren't buffered.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return r.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// accessLogEntry is the shape of a --log-format=json access log line.
+type accessLogEntry struct {
+	Timestamp      string  `json:"ts"`
+	Method         string  `json:"method"`
+	Path           string  `json:"path"`
+	Status         int     `json:"status"`
+	Bytes          int     `json:"bytes"`
+	DurationMillis float64 `json:"duration_ms"`
+	RemoteAddr     string  `json:"remote_addr"`
+	ServicePrefix  string  `json:"service_prefix"`
+	UpstreamHost   string  `json:"upstream_host,omitempty"`
+	UpstreamStatus int     `json:"upstream_status,omitempty"`
+	Websocket      bool    `json:"ws,omitempty"`
+}
+
+// accessLogMiddleware wraps next, writing one access log line per request in
+// the given format. servicePrefix is the prefix that matched ("static" for
+// the static content handler), upstreamHost is the proxied backend's host
+// (empty for static content).
+func accessLogMiddleware(format, servicePrefix, upstreamHost string, next http.Handler) http.Handler {
+	if format == logFormatCombined {
+		return handlers.CombinedLoggingHandler(os.Stdout, next)
+	}
+	if format == logFormatCommon {
+		return handlers.LoggingHandler(os.Stdout, next)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		ws := isWebsocket(r)
+		next.ServeHTTP(rec, r)
+
+		entry := accessLogEntry{
+			Timestamp:      start.UTC().Format(time.RFC3339Nano),
+			Method:         r.Method,
+			Path:           r.URL.Path,
+			Status:         rec.status,
+			Bytes:          rec.bytes,
+			DurationMillis: float64(time.Since(start)) / float64(time.Millisecond),
+			RemoteAddr:     r.RemoteAddr,
+			ServicePrefix:  servicePrefix,
+			UpstreamHost:   upstreamHost,
+			Websocket:      ws,
+		}
+		if len(upstreamHost) > 0 {
+			entry.UpstreamStatus = rec.status
+		}
+		if data, err := json.Marshal(entry); err == nil {
+			fmt.Fprintln(os.Stdout, string(data))
+		}
+	})
+}
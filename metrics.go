@@ -0,0 +1,134 @@
+// Prometheus /metrics endpoint, instrumenting both the static file server
+// and the reverse-proxy handlers via the same middleware pipeline.
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kuisp_requests_total",
+		Help: "Total number of requests handled, by service prefix, method and status code.",
+	}, []string{"service", "method", "status"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kuisp_request_duration_seconds",
+		Help:    "Request latency in seconds, by service prefix.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"service"})
+
+	inFlightRequests = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kuisp_in_flight_requests",
+		Help: "Number of requests currently being served, by service prefix.",
+	}, []string{"service"})
+
+	upstreamErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kuisp_upstream_errors_total",
+		Help: "Total number of upstream (5xx) responses, by service prefix.",
+	}, []string{"service"})
+
+	websocketConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kuisp_websocket_connections",
+		Help: "Number of currently open websocket connections, by service prefix.",
+	}, []string{"service"})
+
+	tlsHandshakeFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kuisp_tls_handshake_failures_total",
+		Help: "Total number of TLS handshake failures seen by the upstream transport.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		requestsTotal,
+		requestDuration,
+		inFlightRequests,
+		upstreamErrorsTotal,
+		websocketConnections,
+		tlsHandshakeFailuresTotal,
+	)
+}
+
+// serveMetrics starts the Prometheus /metrics endpoint in the background.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		log.Printf("Serving metrics on %s/metrics\n", addr)
+		log.Fatal(http.ListenAndServe(addr, mux))
+	}()
+}
+
+// instrumentTLSHandshakes wraps transport's TLS dialer so a failed upstream
+// handshake (expired/rotated cert, protocol mismatch, etc.) increments
+// tlsHandshakeFailuresTotal, giving operators a signal independent of the
+// resulting 5xx. Callers must call http2.ConfigureTransport(transport) first
+// so the dialed *tls.Conn's negotiated protocol is still recognised and HTTP/2
+// keeps working.
+func instrumentTLSHandshakes(transport *http.Transport) {
+	dialer := &net.Dialer{}
+	transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		rawConn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		conn := tls.Client(rawConn, transport.TLSClientConfig)
+		if err := conn.HandshakeContext(ctx); err != nil {
+			tlsHandshakeFailuresTotal.Inc()
+			rawConn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// metricsMiddleware records per-request metrics for the given service prefix.
+func metricsMiddleware(service string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlightRequests.WithLabelValues(service).Inc()
+		defer inFlightRequests.WithLabelValues(service).Dec()
+
+		if isWebsocket(r) {
+			websocketConnections.WithLabelValues(service).Inc()
+			defer websocketConnections.WithLabelValues(service).Dec()
+		}
+
+		start := time.Now()
+		rec, ok := w.(*statusRecorder)
+		if !ok {
+			rec = &statusRecorder{ResponseWriter: w}
+		}
+		next.ServeHTTP(rec, r)
+
+		requestDuration.WithLabelValues(service).Observe(time.Since(start).Seconds())
+		requestsTotal.WithLabelValues(service, r.Method, strconv.Itoa(rec.status)).Inc()
+		if rec.status >= http.StatusInternalServerError {
+			upstreamErrorsTotal.WithLabelValues(service).Inc()
+		}
+	})
+}
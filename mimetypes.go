@@ -0,0 +1,42 @@
+// Static-asset MIME type registration, for platforms whose system mime.types
+// don't know about the extensions frontend builds commonly ship.
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "mime"
+
+// registerMimeTypes adds extension-to-MIME mappings that http.FileServer
+// would otherwise get wrong or miss entirely, depending on the host's system
+// mime.types file (or lack of one, e.g. in a minimal container image).
+func registerMimeTypes() {
+	extraTypes := map[string]string{
+		".css":   "text/css; charset=utf-8",
+		".js":    "application/javascript",
+		".mjs":   "application/javascript",
+		".json":  "application/json",
+		".map":   "application/json",
+		".svg":   "image/svg+xml",
+		".wasm":  "application/wasm",
+		".woff":  "font/woff",
+		".woff2": "font/woff2",
+	}
+	for ext, typ := range extraTypes {
+		if err := mime.AddExtensionType(ext, typ); err != nil {
+			continue
+		}
+	}
+}
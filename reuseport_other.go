@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import "net"
+
+// reusePortListenConfig returns a plain net.ListenConfig on platforms where
+// SO_REUSEPORT isn't wired up.
+func reusePortListenConfig() *net.ListenConfig {
+	return &net.ListenConfig{}
+}
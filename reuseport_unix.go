@@ -0,0 +1,29 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reusePortListenConfig returns a net.ListenConfig that sets SO_REUSEPORT on
+// the listening socket, so multiple kuisp processes (or multiple --addr
+// entries on the same port) can share the same port.
+func reusePortListenConfig() *net.ListenConfig {
+	return &net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+}
@@ -0,0 +1,233 @@
+// Pluggable request/response transformation pipeline for proxied services,
+// modelled on tofuproxy's "rounds": small composable steps that each
+// inspect/mutate the request or response.
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxRewriteLinksBody caps how much of a text/html response rewriteLinksRound
+// will buffer to scan for backend self-links. Responses over the cap (or
+// without html/non-html content types at all - SSE, long-poll/watch streams,
+// plain JSON) are streamed straight through untouched.
+const maxRewriteLinksBody = 1 << 20 // 1MiB
+
+// ProxyRound is a single pluggable step in a service's request-transformation
+// pipeline. Downstream forks can implement their own rounds and register them
+// in buildProxyRounds without touching the core proxy wiring.
+type ProxyRound interface {
+	// Name identifies the round, e.g. for logging.
+	Name() string
+	// Wrap returns next wrapped with this round's behaviour.
+	Wrap(next http.Handler) http.Handler
+}
+
+// applyRounds wraps handler with each round in order, so the first round in
+// the slice is the outermost handler.
+func applyRounds(rounds []ProxyRound, handler http.Handler) http.Handler {
+	for i := len(rounds) - 1; i >= 0; i-- {
+		handler = rounds[i].Wrap(handler)
+	}
+	return handler
+}
+
+// buildProxyRounds assembles the pipeline for a single service backed by
+// backend and reachable under prefix, honouring the --proxy-rewrite-links,
+// --proxy-strip-request-header and --proxy-inject-request-header flags.
+func buildProxyRounds(options *Options, backend *url.URL, prefix string) []ProxyRound {
+	var rounds []ProxyRound
+	if len(options.ProxyStripRequestHeaders) > 0 || len(options.ProxyInjectRequestHeaders) > 0 {
+		rounds = append(rounds, &headerRound{
+			strip:  options.ProxyStripRequestHeaders,
+			inject: options.ProxyInjectRequestHeaders,
+		})
+	}
+	if options.ProxyRewriteLinks {
+		rounds = append(rounds, &rewriteLinksRound{backend: backend, publicPrefix: prefix})
+	}
+	return rounds
+}
+
+// headerNames is a repeatable pflag.Value collecting --proxy-strip-request-header values.
+type headerNames []string
+
+func (h *headerNames) String() string {
+	return strings.Join(*h, ",")
+}
+
+func (h *headerNames) Set(value string) error {
+	*h = append(*h, value)
+	return nil
+}
+
+func (h *headerNames) Type() string {
+	return "stringArray"
+}
+
+// headerMap is a repeatable pflag.Value collecting --proxy-inject-request-header
+// values of the form "Name=value".
+type headerMap map[string]string
+
+func (h *headerMap) String() string {
+	var parts []string
+	for name, value := range *h {
+		parts = append(parts, name+"="+value)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (h *headerMap) Set(value string) error {
+	name, val, _ := strings.Cut(value, "=")
+	if *h == nil {
+		*h = map[string]string{}
+	}
+	(*h)[strings.TrimSpace(name)] = strings.TrimSpace(val)
+	return nil
+}
+
+func (h *headerMap) Type() string {
+	return "stringToString"
+}
+
+// headerRound strips and injects request headers before the request reaches
+// the backend.
+type headerRound struct {
+	strip  []string
+	inject map[string]string
+}
+
+func (r *headerRound) Name() string { return "headers" }
+
+func (r *headerRound) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, name := range r.strip {
+			req.Header.Del(name)
+		}
+		for name, value := range r.inject {
+			req.Header.Set(name, value)
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// rewriteLinksRound rewrites absolute URLs pointing at the backend - in the
+// Location header and in HTML href="..."/src="..." attributes - to the
+// service's public prefix, for backends that generate absolute self-links.
+type rewriteLinksRound struct {
+	backend      *url.URL
+	publicPrefix string
+}
+
+func (r *rewriteLinksRound) Name() string { return "rewrite-links" }
+
+func (r *rewriteLinksRound) Wrap(next http.Handler) http.Handler {
+	backendBase := r.backend.Scheme + "://" + r.backend.Host
+	attrPattern := regexp.MustCompile(`((?:href|src)=["'])` + regexp.QuoteMeta(backendBase))
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lw := &linkRewriteWriter{
+			ResponseWriter: w,
+			backendBase:    backendBase,
+			publicPrefix:   r.publicPrefix,
+			attrPattern:    attrPattern,
+		}
+		next.ServeHTTP(lw, req)
+		lw.Close()
+	})
+}
+
+// linkRewriteWriter defers to the underlying ResponseWriter for every
+// response except small text/html bodies, which it buffers so backend
+// self-links can be rewritten. Everything else - SSE, long-poll/watch
+// streams, large payloads - is streamed straight through unbuffered, so
+// enabling --proxy-rewrite-links never breaks them.
+type linkRewriteWriter struct {
+	http.ResponseWriter
+	backendBase  string
+	publicPrefix string
+	attrPattern  *regexp.Regexp
+
+	wroteHeader bool
+	buffering   bool
+	status      int
+	buf         bytes.Buffer
+}
+
+func (w *linkRewriteWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+
+	if loc := w.Header().Get("Location"); strings.HasPrefix(loc, w.backendBase) {
+		w.Header().Set("Location", w.publicPrefix+strings.TrimPrefix(loc, w.backendBase))
+	}
+
+	contentLength, _ := strconv.Atoi(w.Header().Get("Content-Length"))
+	w.buffering = strings.Contains(w.Header().Get("Content-Type"), "text/html") &&
+		(contentLength == 0 || contentLength <= maxRewriteLinksBody)
+	if !w.buffering {
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *linkRewriteWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.buffering {
+		return w.ResponseWriter.Write(p)
+	}
+	if w.buf.Len()+len(p) > maxRewriteLinksBody {
+		// Grew past the cap after all (no/wrong Content-Length) - flush what's
+		// buffered unrewritten and stream the remainder straight through.
+		w.buffering = false
+		w.Header().Del("Content-Length")
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(w.buf.Bytes())
+		return w.ResponseWriter.Write(p)
+	}
+	return w.buf.Write(p)
+}
+
+func (w *linkRewriteWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close rewrites and flushes any buffered body once the handler has
+// finished writing. A no-op if the response was streamed through directly.
+func (w *linkRewriteWriter) Close() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.buffering {
+		return
+	}
+	body := w.attrPattern.ReplaceAll(w.buf.Bytes(), []byte(`${1}`+w.publicPrefix))
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(body)
+}
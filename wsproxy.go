@@ -0,0 +1,103 @@
+// Websocket reverse proxying for a single service.
+//
+// Copyright 2015 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/koding/websocketproxy"
+)
+
+// forwardedWebsocketHeaderNames are the request headers copied through to the
+// upstream websocket dial, in addition to Authorization.
+var forwardedWebsocketHeaderNames = []string{"Cookie", "X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host"}
+
+// websocketScheme derives the ws/wss scheme to dial from the backend
+// service's own scheme, rather than always assuming TLS.
+func websocketScheme(backendScheme string) string {
+	if backendScheme == "https" {
+		return "wss"
+	}
+	return "ws"
+}
+
+// forwardedWebsocketHeaders builds the extra headers to send when dialing
+// the upstream websocket, for use from a websocketproxy.WebsocketProxy's
+// Director (which otherwise only forwards Origin/Sec-WebSocket-Protocol/
+// Cookie/Host and the X-Forwarded-* pair itself): the allow-listed request
+// headers (if present), plus Authorization - either the configured bearer
+// token, or forwarded from the incoming request.
+func forwardedWebsocketHeaders(in http.Header, authHeader string) http.Header {
+	out := make(http.Header, len(forwardedWebsocketHeaderNames)+1)
+	for _, name := range forwardedWebsocketHeaderNames {
+		if v := in.Get(name); len(v) > 0 {
+			out.Set(name, v)
+		}
+	}
+	if len(authHeader) > 0 {
+		out.Set("Authorization", authHeader)
+	} else if v := in.Get("Authorization"); len(v) > 0 {
+		out.Set("Authorization", v)
+	}
+	return out
+}
+
+// websocketProxyHandler proxies a websocket upgrade request through to
+// backend, dialing with the given tlsConfig (so --ca-cert/--skip-cert-validation
+// apply to websockets the same as regular proxied requests) and forwarding
+// the bearer token (authHeader, or the raw token as an access_token query
+// parameter if the backend expects that instead) and allow-listed headers.
+func websocketProxyHandler(prefix string, backend *url.URL, tlsConfig *tls.Config, token, authHeader string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// shallow copy
+		u := *r.URL
+		u.Host = backend.Host
+		u.Scheme = websocketScheme(backend.Scheme)
+		u.Path = strings.TrimPrefix(u.Path, prefix)
+
+		// lets add the token if its missing
+		parameters := u.Query()
+		if len(token) > 0 {
+			tokenParam := parameters.Get("access_token")
+			if len(tokenParam) == 0 {
+				parameters.Set("access_token", token)
+				u.RawQuery = parameters.Encode()
+			}
+		}
+		log.Printf("Creating websocket proxy to %v\n", &u)
+
+		// shallow copy
+		pr := *r
+		pr.URL = &u
+
+		proxy := websocketproxy.NewProxy(&u)
+		proxy.Dialer = &websocket.Dialer{
+			TLSClientConfig: tlsConfig,
+		}
+		proxy.Director = func(incoming *http.Request, out http.Header) {
+			for name, values := range forwardedWebsocketHeaders(incoming.Header, authHeader) {
+				out[name] = values
+			}
+		}
+		proxy.ServeHTTP(w, &pr)
+	})
+}
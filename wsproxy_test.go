@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestWebsocketProxyHandler verifies that a bearer token set via the proxy's
+// Authorization header flows through to the upstream websocket dial, and
+// that the dial succeeds against a self-signed upstream once its certificate
+// is trusted (mirroring --ca-cert).
+func TestWebsocketProxyHandler(t *testing.T) {
+	var gotAuth string
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Fatalf("backend could not upgrade: %v", err)
+		}
+		defer conn.Close()
+		mt, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.WriteMessage(mt, msg)
+	}))
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatalf("could not parse backend URL: %v", err)
+	}
+
+	certPool := x509.NewCertPool()
+	certPool.AddCert(backend.Certificate())
+	tlsConfig := &tls.Config{RootCAs: certPool}
+
+	const prefix = "/svc/"
+	proxy := httptest.NewServer(websocketProxyHandler(prefix, backendURL, tlsConfig, "", "Bearer test-token"))
+	defer proxy.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(proxy.URL, "http") + prefix
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("could not dial proxied websocket: %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("ping")); err != nil {
+		t.Fatalf("could not write message: %v", err)
+	}
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("could not read echoed message: %v", err)
+	}
+	if string(msg) != "ping" {
+		t.Errorf("got echoed message %q, want %q", msg, "ping")
+	}
+
+	if gotAuth != "Bearer test-token" {
+		t.Errorf("backend saw Authorization %q, want %q", gotAuth, "Bearer test-token")
+	}
+}
+
+// TestWebsocketScheme verifies the ws/wss scheme is derived from the
+// backend's own scheme rather than always assuming TLS.
+func TestWebsocketScheme(t *testing.T) {
+	if got := websocketScheme("http"); got != "ws" {
+		t.Errorf("websocketScheme(http) = %q, want %q", got, "ws")
+	}
+	if got := websocketScheme("https"); got != "wss" {
+		t.Errorf("websocketScheme(https) = %q, want %q", got, "wss")
+	}
+}